@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// statusResponse is the payload for GET /control/status.
+type statusResponse struct {
+	ServerIP      string `json:"serverIp"`
+	PoolStart     string `json:"poolStart"`
+	LeaseRange    int    `json:"leaseRange"`
+	LeaseDuration string `json:"leaseDuration"`
+	DBConnected   bool   `json:"dbConnected"`
+	DynamicLeases int    `json:"dynamicLeases"`
+	StaticLeases  int    `json:"staticLeases"`
+}
+
+// interfaceInfo is one entry of GET /control/dhcp/interfaces.
+type interfaceInfo struct {
+	Name         string   `json:"name"`
+	MTU          int      `json:"mtu"`
+	HardwareAddr string   `json:"hardwareAddr"`
+	Addresses    []string `json:"addresses"`
+	Flags        string   `json:"flags"`
+}
+
+// leaseInfo is one entry of GET /control/dhcp/leases.
+type leaseInfo struct {
+	Mac      string `json:"mac"`
+	IP       string `json:"ip"`
+	Expiry   string `json:"expiry"`
+	Username string `json:"username,omitempty"`
+	Static   bool   `json:"static"`
+}
+
+// staticLeaseRequest is the body of POST /control/dhcp/static.
+type staticLeaseRequest struct {
+	Action string `json:"action"` // "add" or "remove"
+	Mac    string `json:"mac"`
+	IP     string `json:"ip"`
+}
+
+// leaseRemoveRequest is the body of POST /control/dhcp/leases/remove.
+type leaseRemoveRequest struct {
+	Mac string `json:"mac"`
+	IP  string `json:"ip"`
+}
+
+// startControlAPI registers the admin endpoints on their own ServeMux and
+// serves them on settings.ControlBindAddr. Meant to be launched with `go`
+// from main alongside the DHCP servers.
+func startControlAPI(h *DHCPHandler) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/control/status", authenticate(h.handleStatus))
+	mux.HandleFunc("/control/dhcp/interfaces", authenticate(h.handleInterfaces))
+	mux.HandleFunc("/control/dhcp/leases", authenticate(h.handleLeases))
+	mux.HandleFunc("/control/dhcp/leases/remove", authenticate(h.handleLeaseRemove))
+	mux.HandleFunc("/control/dhcp/static", authenticate(h.handleStatic))
+
+	log.Printf("Starting control API on %v\n", settings.ControlBindAddr)
+	log.Fatal(http.ListenAndServe(settings.ControlBindAddr, mux))
+}
+
+// authenticate wraps next with HTTP basic auth checked against the
+// credentials loaded from config.json.
+func authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != settings.ControlUser || pass != settings.ControlPassword {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dhcpdorf"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (h *DHCPHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	h.leasesMu.Lock()
+	dynamicLeases, staticLeases := len(h.leases), len(h.statics)
+	h.leasesMu.Unlock()
+
+	resp := statusResponse{
+		ServerIP:      h.ip.String(),
+		PoolStart:     h.start.String(),
+		LeaseRange:    h.leaseRange,
+		LeaseDuration: h.leaseDuration.String(),
+		DBConnected:   h.dbmap != nil && h.dbmap.Db.Ping() == nil,
+		DynamicLeases: dynamicLeases,
+		StaticLeases:  staticLeases,
+	}
+	writeJSON(w, resp)
+}
+
+func (h *DHCPHandler) handleInterfaces(w http.ResponseWriter, r *http.Request) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]interfaceInfo, 0, len(ifaces))
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		addrStrings := make([]string, 0, len(addrs))
+		for _, a := range addrs {
+			addrStrings = append(addrStrings, a.String())
+		}
+		infos = append(infos, interfaceInfo{
+			Name:         iface.Name,
+			MTU:          iface.MTU,
+			HardwareAddr: iface.HardwareAddr.String(),
+			Addresses:    addrStrings,
+			Flags:        iface.Flags.String(),
+		})
+	}
+	writeJSON(w, infos)
+}
+
+func (h *DHCPHandler) handleLeases(w http.ResponseWriter, r *http.Request) {
+	usernames := h.usernamesByMac()
+
+	h.leasesMu.Lock()
+	leases := make([]leaseInfo, 0, len(h.leases)+len(h.statics))
+	for i, l := range h.leases {
+		ip := dhcp.IPAdd(h.start, i)
+		leases = append(leases, leaseInfo{
+			Mac:      l.nic.String(),
+			IP:       ip.String(),
+			Expiry:   l.expiry.Format(time.RFC3339),
+			Username: usernames[l.nic.String()],
+			Static:   false,
+		})
+	}
+	for _, s := range h.statics {
+		leases = append(leases, leaseInfo{
+			Mac:      s.nic.String(),
+			IP:       s.ip.String(),
+			Expiry:   s.expiry.Format(time.RFC3339),
+			Username: usernames[s.nic.String()],
+			Static:   true,
+		})
+	}
+	h.leasesMu.Unlock()
+	writeJSON(w, leases)
+}
+
+// usernamesByMac joins the DB's `user` table against leases by MAC address.
+func (h *DHCPHandler) usernamesByMac() map[string]string {
+	usernames := map[string]string{}
+	if h.dbmap == nil {
+		return usernames
+	}
+	var rows []userTable
+	if _, err := h.dbmap.Select(&rows, "SELECT `MAC`, `username` from user"); err != nil {
+		log.Printf("control API: could not join usernames: %v\n", err)
+		return usernames
+	}
+	for _, row := range rows {
+		usernames[row.Mac] = row.Username
+	}
+	return usernames
+}
+
+func (h *DHCPHandler) handleLeaseRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	var req leaseRemoveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.leasesMu.Lock()
+	for i, v := range h.leases {
+		if (req.Mac != "" && v.nic.String() == req.Mac) ||
+			(req.IP != "" && dhcp.IPAdd(h.start, i).Equal(net.ParseIP(req.IP))) {
+			delete(h.leases, i)
+			log.Printf("control API: removed lease offset %v (mac=%v)\n", i, v.nic)
+		}
+	}
+	h.leasesMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *DHCPHandler) handleStatic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	var req staticLeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Action {
+	case "add":
+		// user.IP only holds the last octet and user.Net the third octet
+		// (the full address is built elsewhere as net.IP{134, 130, Net, IP}),
+		// so req.IP has to be broken into those two columns rather than
+		// written as a dotted-quad string.
+		ip4 := net.ParseIP(req.IP).To4()
+		if ip4 == nil || ip4[0] != 134 || ip4[1] != 130 {
+			http.Error(w, "ip must be a dotted-quad address in 134.130.0.0/16", http.StatusBadRequest)
+			return
+		}
+		netOctet, ipOctet := int32(ip4[2]), int32(ip4[3])
+
+		// MAC = ? and (Net, IP) = ? can each match a different existing row
+		// (e.g. reassigning a MAC that's already bound to the IP someone
+		// else currently holds), so resolve the match to a single row first
+		// instead of letting a single UPDATE silently fold two rows into
+		// duplicate bindings.
+		var ids []int64
+		if _, err := h.dbmap.Select(&ids, "SELECT `ID` from `user` WHERE `MAC` = ? OR (`Net` = ? AND `IP` = ?)",
+			req.Mac, netOctet, ipOctet); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(ids) == 0 {
+			http.Error(w, "no user row matched mac or ip", http.StatusNotFound)
+			return
+		}
+		if len(ids) > 1 {
+			http.Error(w, "mac and ip matched different user rows, resolve the conflict manually", http.StatusConflict)
+			return
+		}
+
+		if _, err := h.dbmap.Exec("UPDATE `user` SET `MAC` = ?, `Net` = ?, `IP` = ? WHERE `ID` = ?",
+			req.Mac, netOctet, ipOctet, ids[0]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "remove":
+		if _, err := h.dbmap.Exec("UPDATE `user` SET `MAC` = '00:00:00:00:00:00' WHERE `MAC` = ?", req.Mac); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "action must be add or remove", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -13,6 +13,8 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,9 +30,17 @@ type staticlease struct {
 }
 
 var settings struct {
-	User     string `json:"user`
-	Password string `json:"password"`
-	Database string `json:"database"`
+	User              string `json:"user`
+	Password          string `json:"password"`
+	Database          string `json:"database"`
+	ICMPTimeoutMsec   int    `json:"ICMPTimeoutMsec"`   // 0 disables the ping-before-offer probe
+	ControlBindAddr   string `json:"controlBindAddr"`
+	ControlUser       string `json:"controlUser"`
+	ControlPassword   string `json:"controlPassword"`
+	LeaseStoreBackend string `json:"leaseStoreBackend"` // "mysql" (default) or "file"
+	LeaseStoreFile    string `json:"leaseStoreFile"`    // used when LeaseStoreBackend is "file"
+	PXETFTPServer     string `json:"PXETFTPServer"`     // TFTP server advertised in SIAddr to PXEClient vendor class
+	PXEBootLoader     string `json:"PXEBootLoader"`     // iPXE loader file name, e.g. undionly.kpxe
 }
 
 type DHCPHandler struct {
@@ -40,9 +50,15 @@ type DHCPHandler struct {
 	start          net.IP              // Start of IP range to distribute
 	leaseRange     int                 // Number of IPs to distribute (starting from start)
 	leaseDuration  time.Duration       // Lease period
+	leasesMu       sync.Mutex          // Guards leases and statics: the DHCP serve loop, the control API and the evictor goroutine all touch them
 	leases         map[int]lease       // Map to keep track of leases
 	statics        map[int]staticlease // Map to keep track of static leases
 	dbmap          *gorp.DbMap
+	icmpTimeout    time.Duration         // Ping-before-offer probe timeout, 0 disables it
+	leaseStore     LeaseStoreBackend     // Where dynamic leases are persisted across restarts
+	bootProfiles   map[string]string     // MAC -> BootProfile, for per-host iPXE boot files
+	pxeOptions     dhcp.Options          // PXE-specific options (SIAddr host, loader name) merged on top of allowed/denied
+	switchPorts    map[string]switchPort // MAC -> expected (switch, port), from option 82 audit
 }
 
 type userTable struct {
@@ -62,26 +78,40 @@ type userTable struct {
 	Validto    time.Time `db:"validto"`
 	Acclevel   string    `db:"acclevel"`
 	Comment    string    `db:"comment"`
-	Switch     string
-	Port       string
-	LastEdit   time.Time `db:lastEdit`
-	Version    int32
+	Switch      string
+	Port        string
+	IPv6        string    `db:"IPv6"`
+	BootProfile string    `db:"BootProfile"`
+	LastEdit    time.Time `db:lastEdit`
+	Version     int32
 }
 
 // Example using DHCP with a single network interface device
 func main() {
 	fmt.Println("Lets get this started")
-	staticleases, dbmap := initializeStaticLeases()
+	staticleases, bootProfiles, switchPorts, dbmap := initializeStaticLeases()
+
+	const leaseRange = 250
+	leaseStore := newLeaseStore(dbmap)
+	dynamicLeases := loadDynamicLeases(leaseStore, leaseRange)
 
 	serverIP := net.IP{134, 130, 172, 5}
 	handler := &DHCPHandler{
 		ip:            serverIP,
 		leaseDuration: 2 * time.Hour,
 		start:         net.IP{192, 168, 172, 3},
-		leaseRange:    250,
-		leases:        make(map[int]lease, 10),
+		leaseRange:    leaseRange,
+		leases:        dynamicLeases,
 		statics:       staticleases,
 		dbmap:         dbmap,
+		icmpTimeout:   time.Duration(settings.ICMPTimeoutMsec) * time.Millisecond,
+		leaseStore:    leaseStore,
+		bootProfiles:  bootProfiles,
+		switchPorts:   switchPorts,
+		pxeOptions: dhcp.Options{
+			dhcp.OptionTFTPServerName: []byte(settings.PXETFTPServer),
+			dhcp.OptionBootFileName:   []byte(settings.PXEBootLoader),
+		},
 		deniedOptions: dhcp.Options{
 			dhcp.OptionSubnetMask:       []byte{255, 255, 255, 0},
 			dhcp.OptionRouter:           []byte(net.IP{192, 168, 172, 2}), // Presuming Server is also your router
@@ -95,54 +125,43 @@ func main() {
 	}
 
 	fmt.Println("Everything Ready for the start :)")
+	go startDHCPv6Server("eth0", dbmap) // DHCPv6 runs alongside v4 on the same interface
+	go startControlAPI(handler)         // Admin/status HTTP API for the running handler
+	go func() {
+		for range time.Tick(time.Minute) {
+			handler.evictExpiredLeases()
+		}
+	}()
 	// log.Fatal(dhcp.ListenAndServe(handler))
 	log.Fatal(dhcp.ListenAndServeIf("eth0", handler)) // Select interface on multi interface device
 }
 
 func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (d dhcp.Packet) {
 
-	// The length N gives the total number of octets in the Agent
-	// Information Field.  The Agent Information field consists of a
-	// sequence of SubOpt/Length/Value tuples for each sub-option, encoded
-	// in the following manner:
-
-	//        SubOpt  Len     Sub-option Value
-	//       +------+------+------+------+------+------+--...-+------+
-	//       |  1   |   N  |  s1  |  s2  |  s3  |  s4  |      |  sN  |
-	//       +------+------+------+------+------+------+--...-+------+
-	//        SubOpt  Len     Sub-option Value
-	//       +------+------+------+------+------+------+--...-+------+
-	//       |  2   |   N  |  i1  |  i2  |  i3  |  i4  |      |  iN  |
-	//       +------+------+------+------+------+------+--...-+------+
-	//
-	// The initial assignment of DHCP Relay Agent Sub-options is as follows:
-
-	//              DHCP Agent              Sub-Option Description
-	//              Sub-option Code
-	//              ---------------         ----------------------
-	//                  1                   Agent Circuit ID Sub-option
-	//                  2                   Agent Remote ID Sub-option
-	// Source: http://tools.ietf.org/html/rfc3046#page-5
-
-	relayAgent := options[dhcp.OptionRelayAgentInformation]
-	// log.Printf("Found RelayAgent Information: %v\n", relayAgent)
-	log.Printf("Should be Port: %v/%v\n", relayAgent[6], relayAgent[7])
-	swHostname := 12 // Circuit ID header + Circuit ID + Remote ID header + string starts after 2
-	log.Printf("Should be Switch: %v\n", string(relayAgent[swHostname:]))
+	// Option 82 (Relay Agent Information) carries a tag/length/value stream
+	// of sub-options; see parseRelayAgentInfo for the format and
+	// http://tools.ietf.org/html/rfc3046#page-5 for the RFC. It's absent
+	// from packets that didn't cross a relay, so this must never assume a
+	// fixed length.
+	relayInfo := parseRelayAgentInfo(options[dhcp.OptionRelayAgentInformation])
 
 	switch msgType {
 
 	case dhcp.Discover:
 		log.Printf("DHCPDISCOVER from %v", p.CHAddr())
 
-		free, options := h.giveOutIP(p)
+		pxeSIAddr, pxeOptions := h.pxeReplyOptions(p, options)
+
+		free, clientOptions := h.giveOutIP(p, relayInfo)
 
 		if free == nil {
 			return nil
 		}
 
-		return dhcp.ReplyPacket(p, dhcp.Offer, h.ip, free, h.leaseDuration,
-			options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+		reply := dhcp.ReplyPacket(p, dhcp.Offer, h.ip, free, h.leaseDuration,
+			clientOptions.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+		h.applyPXEOptions(reply, pxeSIAddr, pxeOptions)
+		return reply
 
 	case dhcp.Request:
 		log.Printf("DHCPREQUEST for %v from %v", net.IP(options[dhcp.OptionRequestedIPAddress]).String(), p.CHAddr())
@@ -150,23 +169,55 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 			log.Println("This DHCP packet is not for me!")
 			return nil // Message not for this dhcp server
 		}
+		pxeSIAddr, pxeOptions := h.pxeReplyOptions(p, options)
+
 		if reqIP := net.IP(options[dhcp.OptionRequestedIPAddress]); len(reqIP) == 4 {
 			if []byte(reqIP)[0] == []byte(h.start)[0] { // if reqIP is in dynamic range
 				if leaseNum := dhcp.IPRange(h.start, reqIP) - 1; leaseNum >= 0 && leaseNum < h.leaseRange { // allow if reqIP is in our range
-					if l, exists := h.leases[leaseNum]; !exists || bytes.Equal(l.nic, p.CHAddr()) { // allow if reqIP doesn't exist yet or MAC is the same
-						h.leases[leaseNum] = lease{nic: p.CHAddr(), expiry: time.Now().Add(h.leaseDuration)} // reserve the IP
+					h.leasesMu.Lock()
+					l, exists := h.leases[leaseNum]
+					granted := !exists || bytes.Equal(l.nic, p.CHAddr()) // allow if reqIP doesn't exist yet or MAC is the same
+					var newLease lease
+					if granted {
+						newLease = lease{nic: p.CHAddr(), expiry: time.Now().Add(h.leaseDuration)}
+						h.leases[leaseNum] = newLease // reserve the IP
+					}
+					h.leasesMu.Unlock()
+					if granted {
+						if h.leaseStore != nil {
+							if err := h.leaseStore.SaveLease(leaseNum, newLease); err != nil {
+								log.Printf("Could not persist lease offset %v: %v\n", leaseNum, err)
+							}
+						}
 						log.Printf("DHCPACK IP %v is granted for MAC %v\n", net.IP(options[dhcp.OptionRequestedIPAddress]).String(), p.CHAddr().String())
-						return dhcp.ReplyPacket(p, dhcp.ACK, h.ip, net.IP(options[dhcp.OptionRequestedIPAddress]), h.leaseDuration,
+						reply := dhcp.ReplyPacket(p, dhcp.ACK, h.ip, net.IP(options[dhcp.OptionRequestedIPAddress]), h.leaseDuration,
 							h.deniedOptions.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+						h.applyPXEOptions(reply, pxeSIAddr, pxeOptions)
+						return reply
 					}
 				}
 			} else {
+				h.leasesMu.Lock()
+				found := false
 				for _, v := range h.statics { // reqIP is not in dynamic range - search for static binding
 					if v.ip.Equal(reqIP) && bytes.Equal(v.nic, p.CHAddr()) {
+						found = true
+						break
+					}
+				}
+				h.leasesMu.Unlock()
+				if found {
+					grantOptions := h.allowedOptions
+					if !authorizePort(h.switchPorts, p.CHAddr().String(), relayInfo) {
+						log.Printf("DHCPACK Quarantining static IP Addr: %v for %v, wrong switch port\n", reqIP.String(), p.CHAddr().String())
+						grantOptions = h.deniedOptions
+					} else {
 						log.Printf("DHCPACK Granting static IP Addr: %v to %v\n", reqIP.String(), p.CHAddr().String())
-						return dhcp.ReplyPacket(p, dhcp.ACK, h.ip, net.IP(options[dhcp.OptionRequestedIPAddress]), h.leaseDuration,
-							h.allowedOptions.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
 					}
+					reply := dhcp.ReplyPacket(p, dhcp.ACK, h.ip, net.IP(options[dhcp.OptionRequestedIPAddress]), h.leaseDuration,
+						grantOptions.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+					h.applyPXEOptions(reply, pxeSIAddr, pxeOptions)
+					return reply
 				}
 			}
 		}
@@ -175,13 +226,22 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 
 	case dhcp.Release, dhcp.Decline:
 		nic := p.CHAddr()
+		h.leasesMu.Lock()
+		releasedOffset := -1
 		for i, v := range h.leases {
 			if bytes.Equal(v.nic, nic) {
 				log.Printf("DHCPRELEASE Releasing address %v for MAC %v\n", i, nic)
 				delete(h.leases, i)
+				releasedOffset = i
 				break
 			}
 		}
+		h.leasesMu.Unlock()
+		if releasedOffset >= 0 && h.leaseStore != nil {
+			if err := h.leaseStore.DeleteLease(releasedOffset); err != nil {
+				log.Printf("Could not remove persisted lease offset %v: %v\n", releasedOffset, err)
+			}
+		}
 
 	case dhcp.Inform:
 		log.Printf("DHCPINFORM from MAC %v and IP %v\n", p.CHAddr().String(), p.CIAddr().String())
@@ -189,7 +249,7 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 	return nil
 }
 
-func initializeStaticLeases() (map[int]staticlease, *gorp.DbMap) {
+func initializeStaticLeases() (map[int]staticlease, map[string]string, map[string]switchPort, *gorp.DbMap) {
 	configFile, err := os.Open("config.json")
 	if err != nil {
 		fmt.Println("opening config file", err.Error())
@@ -202,20 +262,23 @@ func initializeStaticLeases() (map[int]staticlease, *gorp.DbMap) {
 	db, err := sql.Open("mymysql", settings.Database+"/"+settings.User+"/"+settings.Password)
 	if err != nil {
 		log.Fatal("Couldn't establish DB Connection!\n", err)
-		return nil, nil
+		return nil, nil, nil, nil
 	}
 	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.MySQLDialect{"MyISAM", "UTF8"}}
-	defer dbmap.Db.Close()
+	// dbmap is kept open for the life of the process: the control API and the
+	// MySQL lease store both hold onto it past this function returning.
 	dbmap.TraceOn("[gorp]", log.New(os.Stdout, "dhcpdorf:", log.Lmicroseconds))
 
 	// fetch all rows
 	var rows []userTable
-	_, err = dbmap.Select(&rows, "SELECT `ID`, `Active`, `Net`, `MAC`, `IP`, `validto`, `Switch`, `Port` from user ORDER BY `Net`, `Room` DESC")
+	_, err = dbmap.Select(&rows, "SELECT `ID`, `Active`, `Net`, `MAC`, `IP`, `validto`, `Switch`, `Port`, `BootProfile` from user ORDER BY `Net`, `Room` DESC")
 	if err != nil {
 		log.Fatal("Couldn't Select All from table!\n", err)
-		return nil, nil
+		return nil, nil, nil, nil
 	}
 	var staticleases = make(map[int]staticlease, 500)
+	var bootProfiles = make(map[string]string, 500)
+	var switchPorts = make(map[string]switchPort, 500)
 
 	for x, p := range rows {
 		rows[x].Active = rows[x].Active && (p.Validto.Equal(time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC)) || !(p.Validto.Before(time.Now())))
@@ -224,6 +287,13 @@ func initializeStaticLeases() (map[int]staticlease, *gorp.DbMap) {
 			log.Fatalf("Found MYSQL Entry with wrong MAC format! ID: %d", rows[x].Id)
 		}
 
+		if rows[x].BootProfile != "" {
+			bootProfiles[rows[x].Mac] = rows[x].BootProfile
+		}
+		if rows[x].Switch != "" || rows[x].Port != "" {
+			switchPorts[rows[x].Mac] = switchPort{Switch: rows[x].Switch, Port: rows[x].Port}
+		}
+
 		if rows[x].Ip == 0 || rows[x].Mac == "00:00:00:00:00:00" {
 			continue
 		}
@@ -235,37 +305,95 @@ func initializeStaticLeases() (map[int]staticlease, *gorp.DbMap) {
 			ip:     net.IP{134, 130, byte(rows[x].Net), byte(rows[x].Ip)},
 		}
 	}
-	return staticleases, dbmap
+	return staticleases, bootProfiles, switchPorts, dbmap
+}
+
+// pxeVendorClass and pxeUserClass identify PXE clients per the convention
+// used by WDS/iPXE: a raw PXE ROM sends vendor class "PXEClient", while an
+// iPXE binary identifies itself via user class "iPXE" so it can be handed a
+// different (HTTP) boot file than the TFTP loader that chain-loaded it.
+const (
+	pxeVendorClass  = "PXEClient"
+	pxeUserClassVal = "iPXE"
+)
+
+// optionUserClass is DHCP option 77 (User Class), not defined by krolaw/dhcp4.
+const optionUserClass = dhcp.OptionCode(77)
+
+// pxeReplyOptions inspects the vendor/user class options (60/77) of an
+// incoming Discover or Request and decides what, if anything, should be
+// added to the reply to chain-boot the client. It returns a nil siaddr and
+// nil options for a non-PXE client.
+func (h *DHCPHandler) pxeReplyOptions(p dhcp.Packet, options dhcp.Options) (net.IP, dhcp.Options) {
+	// Real PXE ROMs send an arch/UNDI suffix after the class, e.g.
+	// "PXEClient:Arch:00000:UNDI:002001", so this has to be a prefix match
+	// rather than exact equality.
+	if !strings.HasPrefix(string(options[dhcp.OptionVendorClassIdentifier]), pxeVendorClass) {
+		return nil, nil
+	}
+
+	extra := dhcp.Options{}
+	for code, val := range h.pxeOptions {
+		extra[code] = val
+	}
+
+	if string(options[optionUserClass]) == pxeUserClassVal {
+		profile := h.bootProfiles[p.CHAddr().String()]
+		if profile == "" {
+			profile = p.CHAddr().String()
+		}
+		extra[dhcp.OptionBootFileName] = []byte(fmt.Sprintf("http://%s/boot/%s.ipxe", settings.PXETFTPServer, profile))
+	}
+
+	return net.ParseIP(settings.PXETFTPServer), extra
+}
+
+// applyPXEOptions sets SIAddr and merges the PXE options computed by
+// pxeReplyOptions onto an already-built reply packet.
+func (h *DHCPHandler) applyPXEOptions(reply dhcp.Packet, siaddr net.IP, options dhcp.Options) {
+	if options == nil {
+		return
+	}
+	reply.SetSIAddr(siaddr)
+	for code, val := range options {
+		reply.AddOption(code, val)
+	}
 }
 
-func (h *DHCPHandler) giveOutIP(p dhcp.Packet) (net.IP, dhcp.Options) {
+func (h *DHCPHandler) giveOutIP(p dhcp.Packet, relayInfo relayAgentInfo) (net.IP, dhcp.Options) {
 	free := net.IP{0, 0, 0, 0}
 	nic := p.CHAddr()
 
+	h.leasesMu.Lock()
 	for _, v := range h.statics {
 		// Check for static binding
 		if bytes.Equal(v.nic, nic) {
 			free = v.ip
+			h.leasesMu.Unlock()
+			if !authorizePort(h.switchPorts, nic.String(), relayInfo) {
+				log.Printf("DHCPOFFER Quarantining static IP Addr: %v for %v, wrong switch port\n", free.String(), p.CHAddr().String())
+				return free, h.deniedOptions
+			}
 			log.Printf("DHCPOFFER static IP Addr: %v to %v\n", free.String(), p.CHAddr().String())
-			return v.ip, h.allowedOptions
+			return free, h.allowedOptions
 		}
 	}
 
-	if free.Equal(net.IP{0, 0, 0, 0}) {
-		// Check for previous dynamic lease
-		for i, v := range h.leases {
-			if bytes.Equal(v.nic, nic) {
-				free = dhcp.IPAdd(h.start, i)
-				log.Printf("DHCPOFFER OLD IP Addr: %v to %v\n", free.String(), p.CHAddr().String())
-				return free, h.deniedOptions
-			}
+	// Check for previous dynamic lease
+	for i, v := range h.leases {
+		if bytes.Equal(v.nic, nic) {
+			free = dhcp.IPAdd(h.start, i)
+			break
 		}
 	}
-
-	if free.Equal(net.IP{0, 0, 0, 0}) {
-		// Create new dynamic lease for client
-		free = h.freeLease()
+	h.leasesMu.Unlock()
+	if !free.Equal(net.IP{0, 0, 0, 0}) {
+		log.Printf("DHCPOFFER OLD IP Addr: %v to %v\n", free.String(), p.CHAddr().String())
+		return free, h.deniedOptions
 	}
+
+	// Create new dynamic lease for client
+	free = h.freeLease()
 	if free.Equal(net.IP{0, 0, 0, 0}) {
 		log.Fatalf("No more free IPs for host %v available :(\n", p.CHAddr().String())
 		return nil, nil
@@ -274,15 +402,67 @@ func (h *DHCPHandler) giveOutIP(p dhcp.Packet) (net.IP, dhcp.Options) {
 	return free, h.deniedOptions
 }
 
+// evictExpiredLeases drops dynamic leases whose expiry has passed from both
+// the in-memory map and the persistence store, so freed offsets don't pile
+// up in the store after freeLease reuses them.
+func (h *DHCPHandler) evictExpiredLeases() {
+	now := time.Now()
+	h.leasesMu.Lock()
+	expired := make([]int, 0)
+	for i, v := range h.leases {
+		if v.expiry.Before(now) {
+			delete(h.leases, i)
+			expired = append(expired, i)
+		}
+	}
+	h.leasesMu.Unlock()
+	if h.leaseStore == nil {
+		return
+	}
+	for _, i := range expired {
+		if err := h.leaseStore.DeleteLease(i); err != nil {
+			log.Printf("Could not remove expired persisted lease offset %v: %v\n", i, err)
+		}
+	}
+}
+
 func (h *DHCPHandler) freeLease() net.IP {
 	now := time.Now()
 	b := rand.Intn(h.leaseRange) // Try random first
 	for _, v := range [][]int{[]int{b, h.leaseRange}, []int{0, b}} {
 		for i := v[0]; i < v[1]; i++ {
-			if l, ok := h.leases[i]; !ok || l.expiry.Before(now) {
-				return dhcp.IPAdd(h.start, i)
+			h.leasesMu.Lock()
+			l, ok := h.leases[i]
+			h.leasesMu.Unlock()
+			if ok && !l.expiry.Before(now) {
+				continue
+			}
+			candidate := dhcp.IPAdd(h.start, i)
+			if h.respondsToPing(candidate) {
+				log.Printf("DHCP offset %v (%v) answered a ping probe, marking as in-use\n", i, candidate.String())
+				conflict := lease{nic: conflictNic, expiry: now.Add(time.Hour)}
+				h.leasesMu.Lock()
+				h.leases[i] = conflict
+				h.leasesMu.Unlock()
+				if h.leaseStore != nil {
+					if err := h.leaseStore.SaveLease(i, conflict); err != nil {
+						log.Printf("Could not persist conflict lease offset %v: %v\n", i, err)
+					}
+				}
+				continue
 			}
+			return candidate
 		}
 	}
 	return net.IP{0, 0, 0, 0}
 }
+
+// respondsToPing runs an ICMP echo probe against ip and reports whether a
+// reply came back before h.icmpTimeout elapses. A zero timeout disables the
+// probe entirely so freeLease behaves exactly as before.
+func (h *DHCPHandler) respondsToPing(ip net.IP) bool {
+	if h.icmpTimeout <= 0 {
+		return false
+	}
+	return pingHost(ip, h.icmpTimeout)
+}
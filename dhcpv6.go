@@ -0,0 +1,268 @@
+package main
+
+import (
+	"log"
+	"math/big"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/insomniacslk/dhcp/iana"
+
+	"github.com/coopernurse/gorp"
+)
+
+// lease6 mirrors lease but keys dynamic DHCPv6 leases on the client's DUID
+// instead of a MAC address, since DUIDs are what SOLICIT/REQUEST carry.
+type lease6 struct {
+	duid   *dhcpv6.DUIDLLT // Client's DUID
+	expiry time.Time       // When the lease expires
+}
+
+type staticlease6 struct {
+	duid   *dhcpv6.DUIDLLT
+	expiry time.Time
+	ip     net.IP
+}
+
+// DHCPv6Handler is the v6 counterpart of DHCPHandler. It is driven by
+// insomniacslk/dhcp/dhcpv6/server6 instead of krolaw/dhcp4, so it keeps its
+// own handler type, but the lease bookkeeping follows the same shape.
+type DHCPv6Handler struct {
+	ip            net.IP               // Server DUID source IP
+	start         net.IP               // Start of IPv6 range to distribute
+	leaseRange    int                  // Number of IPs to distribute (starting from start)
+	leaseDuration time.Duration        // Lease period
+	leasesMu      sync.Mutex           // Guards leases and statics, same as DHCPHandler.leasesMu
+	leases        map[int]lease6       // Map to keep track of leases
+	statics       map[int]staticlease6 // Map to keep track of static leases
+	dbmap         *gorp.DbMap
+	serverDUID    *dhcpv6.DUIDLLT
+}
+
+// ServeDHCPv6 is the server6.Handler for the DHCPv6 server. It handles
+// SOLICIT/REQUEST/RELEASE the same way ServeDHCP handles DISCOVER/REQUEST for
+// v4: static bindings win first, then existing dynamic leases, then a fresh
+// one out of the pool.
+func (h *DHCPv6Handler) ServeDHCPv6(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
+	msg, err := m.GetInnerMessage()
+	if err != nil {
+		log.Printf("DHCPv6: could not get inner message: %v\n", err)
+		return
+	}
+
+	switch msg.MessageType {
+	case dhcpv6.MessageTypeSolicit:
+		log.Printf("DHCPv6 SOLICIT from %v", msg.Options.ClientID())
+
+		// SOLICIT only previews an address; committing it to h.leases here
+		// would let a client that never follows up with REQUEST squat on the
+		// offset for up to leaseDuration, same as the v4 handler avoids doing
+		// in its Discover case.
+		free, _ := h.offerIP(msg)
+		if free == nil {
+			return
+		}
+
+		adv, err := dhcpv6.NewAdvertiseFromSolicit(msg,
+			dhcpv6.WithServerID(h.serverDUID),
+			dhcpv6.WithIANA(dhcpv6.OptIAAddress{IPv6Addr: free, PreferredLifetime: h.leaseDuration, ValidLifetime: h.leaseDuration}),
+		)
+		if err != nil {
+			log.Printf("DHCPv6: could not build ADVERTISE: %v\n", err)
+			return
+		}
+		if _, err := conn.WriteTo(adv.ToBytes(), peer); err != nil {
+			log.Printf("DHCPv6: could not send ADVERTISE: %v\n", err)
+		}
+
+	case dhcpv6.MessageTypeRequest:
+		clientID := msg.Options.ClientID()
+		log.Printf("DHCPv6 REQUEST from %v", clientID)
+
+		free, offset := h.offerIP(msg)
+		if free == nil {
+			log.Printf("DHCPv6: no lease available for %v, dropping\n", clientID)
+			return
+		}
+
+		if offset >= 0 {
+			if llt, ok := clientID.(*dhcpv6.DUIDLLT); ok {
+				h.leasesMu.Lock()
+				h.leases[offset] = lease6{duid: llt, expiry: time.Now().Add(h.leaseDuration)}
+				h.leasesMu.Unlock()
+			}
+		}
+
+		reply, err := dhcpv6.NewReplyFromMessage(msg,
+			dhcpv6.WithServerID(h.serverDUID),
+			dhcpv6.WithIANA(dhcpv6.OptIAAddress{IPv6Addr: free, PreferredLifetime: h.leaseDuration, ValidLifetime: h.leaseDuration}),
+		)
+		if err != nil {
+			log.Printf("DHCPv6: could not build REPLY: %v\n", err)
+			return
+		}
+		if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+			log.Printf("DHCPv6: could not send REPLY: %v\n", err)
+		}
+
+	case dhcpv6.MessageTypeRelease:
+		duid := msg.Options.ClientID()
+		h.leasesMu.Lock()
+		for i, v := range h.leases {
+			if duidEqual(v.duid, duid) {
+				log.Printf("DHCPv6 RELEASE releasing offset %v for DUID %v\n", i, duid)
+				delete(h.leases, i)
+				break
+			}
+		}
+		h.leasesMu.Unlock()
+
+	default:
+		log.Printf("DHCPv6: ignoring message type %v from %v\n", msg.MessageType, peer)
+	}
+}
+
+// offerIP mirrors DHCPHandler.giveOutIP: static bindings first, then an
+// existing dynamic lease for this DUID, then a fresh one out of the pool. The
+// returned offset is >= 0 only for a brand new pool address, meaning the
+// caller still needs to commit it to h.leases (done on REQUEST, not SOLICIT,
+// so previewing an address on SOLICIT can't consume a pool slot on its own).
+func (h *DHCPv6Handler) offerIP(m *dhcpv6.Message) (net.IP, int) {
+	duid := m.Options.ClientID()
+
+	h.leasesMu.Lock()
+	for _, v := range h.statics {
+		if duidEqual(v.duid, duid) {
+			h.leasesMu.Unlock()
+			log.Printf("DHCPv6 OFFER static IP Addr: %v to %v\n", v.ip, duid)
+			return v.ip, -1
+		}
+	}
+
+	for i, v := range h.leases {
+		if duidEqual(v.duid, duid) {
+			h.leasesMu.Unlock()
+			free := ip6Add(h.start, i)
+			log.Printf("DHCPv6 OFFER OLD IP Addr: %v to %v\n", free, duid)
+			return free, -1
+		}
+	}
+	h.leasesMu.Unlock()
+
+	if _, ok := duid.(*dhcpv6.DUIDLLT); !ok {
+		log.Printf("DHCPv6: client %v did not send a DUID-LLT, cannot track a lease for it\n", duid)
+		return nil, -1
+	}
+
+	free, offset := h.freeLease()
+	if free == nil {
+		log.Printf("DHCPv6: no more free IPs available for %v\n", duid)
+	}
+	return free, offset
+}
+
+// freeLease finds the first unused or expired offset in the pool and returns
+// its address without committing it to h.leases; the caller decides whether
+// the commit should actually happen.
+func (h *DHCPv6Handler) freeLease() (net.IP, int) {
+	now := time.Now()
+	b := rand.Intn(h.leaseRange) // Try random first, same strategy as the v4 pool
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	for _, v := range [][]int{{b, h.leaseRange}, {0, b}} {
+		for i := v[0]; i < v[1]; i++ {
+			if l, ok := h.leases[i]; !ok || l.expiry.Before(now) {
+				return ip6Add(h.start, i), i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// ip6Add returns the IPv6 address offset bytes past start. There's no
+// dhcp4-style IPAdd helper for v6, so the 128-bit address is added to as a
+// big.Int and re-sliced back to 16 bytes.
+func ip6Add(start net.IP, offset int) net.IP {
+	sum := new(big.Int).Add(new(big.Int).SetBytes(start.To16()), big.NewInt(int64(offset)))
+	raw := sum.Bytes()
+	result := make(net.IP, net.IPv6len)
+	copy(result[net.IPv6len-len(raw):], raw)
+	return result
+}
+
+func duidEqual(a, b dhcpv6.DUID) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a.Equal(b)
+}
+
+// initializeStaticLeases6 reads the same `user` table as the v4 side, keyed
+// off the `IPv6` column instead of `IP`/`Net`.
+func initializeStaticLeases6(dbmap *gorp.DbMap) map[int]staticlease6 {
+	var rows []userTable
+	_, err := dbmap.Select(&rows, "SELECT `ID`, `Active`, `MAC`, `IPv6`, `validto` from user ORDER BY `Net`, `Room` DESC")
+	if err != nil {
+		log.Fatal("Couldn't Select All from table for IPv6 static leases!\n", err)
+		return nil
+	}
+
+	staticleases := make(map[int]staticlease6, 500)
+	for x, p := range rows {
+		if p.IPv6 == "" || p.Mac == "00:00:00:00:00:00" {
+			continue
+		}
+		ip := net.ParseIP(p.IPv6)
+		if ip == nil {
+			log.Printf("Found MYSQL Entry with invalid IPv6 address! ID: %d\n", p.Id)
+			continue
+		}
+		mac, err := net.ParseMAC(p.Mac)
+		if err != nil {
+			log.Fatalf("Found MYSQL Entry with wrong MAC format! ID: %d", p.Id)
+		}
+		duid := &dhcpv6.DUIDLLT{HWType: iana.HWTypeEthernet, LinkLayerAddr: mac}
+		log.Printf("Found IPv6 static lease: %v -> %v", p.Mac, ip)
+
+		staticleases[x] = staticlease6{
+			duid:   duid,
+			expiry: time.Now().Add(time.Hour),
+			ip:     ip,
+		}
+	}
+	return staticleases
+}
+
+// startDHCPv6Server wires up a DHCPv6Handler and runs server6 on the given
+// interface. Intended to be launched with `go` from main alongside the v4
+// server, sharing the same config.json and DB connection.
+func startDHCPv6Server(iface string, dbmap *gorp.DbMap) {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		log.Fatalf("DHCPv6: could not look up interface %v: %v\n", iface, err)
+	}
+
+	handler := &DHCPv6Handler{
+		ip:            net.ParseIP("2001:638:1018:172::5"),
+		leaseDuration: 2 * time.Hour,
+		start:         net.ParseIP("2001:638:1018:172::1000"),
+		leaseRange:    250,
+		leases:        make(map[int]lease6, 10),
+		statics:       initializeStaticLeases6(dbmap),
+		dbmap:         dbmap,
+		serverDUID:    &dhcpv6.DUIDLLT{HWType: iana.HWTypeEthernet, LinkLayerAddr: link.HardwareAddr},
+	}
+
+	laddr := &net.UDPAddr{Port: dhcpv6.DefaultServerPort}
+	server, err := server6.NewServer(iface, laddr, handler.ServeDHCPv6)
+	if err != nil {
+		log.Fatal("Couldn't start DHCPv6 server!\n", err)
+		return
+	}
+
+	log.Fatal(server.Serve())
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	ping "github.com/go-ping/ping"
+)
+
+// conflictNic is the pseudo MAC stored for a lease offset that answered a
+// ping-before-offer probe, so freeLease treats it as in-use without
+// attributing it to any real client.
+var conflictNic = net.HardwareAddr{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+// pingHost sends a single ICMP echo to ip and reports whether a reply
+// arrived within timeout. Mirrors AdGuard Home's DHCP conflict check: a host
+// that responds to a ping already owns that address, statically or not, so
+// we shouldn't offer it.
+//
+// The actual probe is indirected through icmpProbe so tests can substitute a
+// fake responder instead of sending real ICMP packets.
+func pingHost(ip net.IP, timeout time.Duration) bool {
+	return icmpProbe(ip, timeout)
+}
+
+// icmpProbe is the seam pingHost calls through; swapped out in tests.
+var icmpProbe = realICMPProbe
+
+func realICMPProbe(ip net.IP, timeout time.Duration) bool {
+	pinger, err := ping.NewPinger(ip.String())
+	if err != nil {
+		log.Printf("ICMP probe: could not create pinger for %v: %v\n", ip, err)
+		return false
+	}
+	pinger.Count = 1
+	pinger.Timeout = timeout
+	pinger.SetPrivileged(true)
+
+	if err := pinger.Run(); err != nil {
+		log.Printf("ICMP probe: ping to %v failed: %v\n", ip, err)
+		return false
+	}
+
+	return pinger.Statistics().PacketsRecv > 0
+}
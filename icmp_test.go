@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func withICMPProbe(t *testing.T, fake func(ip net.IP, timeout time.Duration) bool) {
+	t.Helper()
+	original := icmpProbe
+	icmpProbe = fake
+	t.Cleanup(func() { icmpProbe = original })
+}
+
+func TestPingHostRespondingTarget(t *testing.T) {
+	withICMPProbe(t, func(ip net.IP, timeout time.Duration) bool {
+		return true
+	})
+
+	if !pingHost(net.IP{192, 168, 172, 10}, 100*time.Millisecond) {
+		t.Error("pingHost() = false, want true for a responding target")
+	}
+}
+
+func TestPingHostNonRespondingTarget(t *testing.T) {
+	withICMPProbe(t, func(ip net.IP, timeout time.Duration) bool {
+		return false
+	})
+
+	if pingHost(net.IP{192, 168, 172, 11}, 100*time.Millisecond) {
+		t.Error("pingHost() = true, want false for a non-responding target")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// LeaseStoreBackend persists the dynamic lease map so it survives a process
+// restart. Implementations only need to track offset -> lease; the dynamic
+// pool's start/leaseRange stay in config.json and are applied by
+// loadDynamicLeases when reading the store back in.
+type LeaseStoreBackend interface {
+	SaveLease(offset int, l lease) error
+	DeleteLease(offset int) error
+	LoadLeases() (map[int]lease, error)
+}
+
+// dynamicLeaseTable is the gorp-mapped row for the `dynamic_lease` table.
+type dynamicLeaseTable struct {
+	Offset int       `db:"Offset"`
+	Mac    string    `db:"MAC"`
+	Expiry time.Time `db:"Expiry"`
+}
+
+// mysqlLeaseStore persists leases to the `dynamic_lease` MySQL table via the
+// same gorp.DbMap used for the `user` table.
+type mysqlLeaseStore struct {
+	dbmap *gorp.DbMap
+}
+
+func newMysqlLeaseStore(dbmap *gorp.DbMap) *mysqlLeaseStore {
+	dbmap.AddTableWithName(dynamicLeaseTable{}, "dynamic_lease").SetKeys(false, "Offset")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		log.Printf("Could not migrate dynamic_lease table: %v\n", err)
+	}
+	return &mysqlLeaseStore{dbmap: dbmap}
+}
+
+func (s *mysqlLeaseStore) SaveLease(offset int, l lease) error {
+	row := dynamicLeaseTable{Offset: offset, Mac: l.nic.String(), Expiry: l.expiry}
+	if count, err := s.dbmap.Update(&row); err != nil {
+		return err
+	} else if count == 0 {
+		return s.dbmap.Insert(&row)
+	}
+	return nil
+}
+
+func (s *mysqlLeaseStore) DeleteLease(offset int) error {
+	_, err := s.dbmap.Exec("DELETE FROM `dynamic_lease` WHERE `Offset` = ?", offset)
+	return err
+}
+
+func (s *mysqlLeaseStore) LoadLeases() (map[int]lease, error) {
+	var rows []dynamicLeaseTable
+	if _, err := s.dbmap.Select(&rows, "SELECT `Offset`, `MAC`, `Expiry` from dynamic_lease"); err != nil {
+		return nil, err
+	}
+
+	leases := make(map[int]lease, len(rows))
+	for _, row := range rows {
+		nic, err := net.ParseMAC(row.Mac)
+		if err != nil {
+			log.Printf("dynamic_lease: skipping offset %v with invalid MAC %v\n", row.Offset, row.Mac)
+			continue
+		}
+		leases[row.Offset] = lease{nic: nic, expiry: row.Expiry}
+	}
+	return leases, nil
+}
+
+// fileLeaseStore persists the lease map as a JSON file, rewritten in full on
+// every mutation. Good enough for dhcpdorf's lease volume and avoids needing
+// a DB connection just to remember a handful of dynamic leases.
+type fileLeaseStore struct {
+	path string
+}
+
+func newFileLeaseStore(path string) *fileLeaseStore {
+	return &fileLeaseStore{path: path}
+}
+
+// fileLeaseEntry is the on-disk representation of one lease; net.HardwareAddr
+// and time.Time don't round-trip cleanly through encoding/json on their own.
+type fileLeaseEntry struct {
+	Offset int       `json:"offset"`
+	Mac    string    `json:"mac"`
+	Expiry time.Time `json:"expiry"`
+}
+
+func (s *fileLeaseStore) readAll() (map[int]fileLeaseEntry, error) {
+	entries := make(map[int]fileLeaseEntry)
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []fileLeaseEntry
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, err
+	}
+	for _, e := range list {
+		entries[e.Offset] = e
+	}
+	return entries, nil
+}
+
+func (s *fileLeaseStore) writeAll(entries map[int]fileLeaseEntry) error {
+	list := make([]fileLeaseEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+
+	f, err := os.Create(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(list)
+}
+
+func (s *fileLeaseStore) SaveLease(offset int, l lease) error {
+	entries, err := s.readAll()
+	if err != nil {
+		return err
+	}
+	entries[offset] = fileLeaseEntry{Offset: offset, Mac: l.nic.String(), Expiry: l.expiry}
+	return s.writeAll(entries)
+}
+
+func (s *fileLeaseStore) DeleteLease(offset int) error {
+	entries, err := s.readAll()
+	if err != nil {
+		return err
+	}
+	delete(entries, offset)
+	return s.writeAll(entries)
+}
+
+func (s *fileLeaseStore) LoadLeases() (map[int]lease, error) {
+	entries, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+
+	leases := make(map[int]lease, len(entries))
+	for offset, e := range entries {
+		nic, err := net.ParseMAC(e.Mac)
+		if err != nil {
+			log.Printf("%v: skipping offset %v with invalid MAC %v\n", s.path, offset, e.Mac)
+			continue
+		}
+		leases[offset] = lease{nic: nic, expiry: e.Expiry}
+	}
+	return leases, nil
+}
+
+// newLeaseStore picks the backend configured in config.json: "file" writes
+// to settings.LeaseStoreFile, anything else (including unset) falls back to
+// the `dynamic_lease` MySQL table so existing deployments keep working
+// without touching config.json.
+func newLeaseStore(dbmap *gorp.DbMap) LeaseStoreBackend {
+	if settings.LeaseStoreBackend == "file" {
+		return newFileLeaseStore(settings.LeaseStoreFile)
+	}
+	return newMysqlLeaseStore(dbmap)
+}
+
+// loadDynamicLeases reads the configured store back into a lease map,
+// discarding entries whose lease has already expired or whose offset no
+// longer falls inside the current start..start+leaseRange pool.
+func loadDynamicLeases(store LeaseStoreBackend, leaseRange int) map[int]lease {
+	stored, err := store.LoadLeases()
+	if err != nil {
+		log.Printf("Could not load persisted dynamic leases: %v\n", err)
+		return make(map[int]lease, 10)
+	}
+
+	now := time.Now()
+	leases := make(map[int]lease, len(stored))
+	for offset, l := range stored {
+		if offset < 0 || offset >= leaseRange {
+			continue
+		}
+		if l.expiry.Before(now) {
+			continue
+		}
+		leases[offset] = l
+	}
+	return leases
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Sub-option codes within DHCP option 82 (Relay Agent Information), per
+// http://tools.ietf.org/html/rfc3046#page-5
+const (
+	agentCircuitIDSubopt = 1
+	agentRemoteIDSubopt  = 2
+)
+
+// relayAgentInfo is the decoded form of option 82: which switch port the
+// client came in on (Circuit ID) and which switch it came in through
+// (Remote ID).
+type relayAgentInfo struct {
+	circuitID []byte
+	remoteID  []byte
+}
+
+// parseRelayAgentInfo walks option 82 as a tag/length/value stream instead of
+// assuming fixed offsets, so it doesn't panic on relay agents that omit a
+// sub-option or pad/order them differently. Unknown sub-options and trailing
+// garbage are ignored.
+func parseRelayAgentInfo(data []byte) relayAgentInfo {
+	var info relayAgentInfo
+	i := 0
+	for i+2 <= len(data) {
+		tag := data[i]
+		length := int(data[i+1])
+		i += 2
+		if i+length > len(data) {
+			log.Printf("Option 82: sub-option %d claims length %d but only %d bytes remain, stopping\n", tag, length, len(data)-i)
+			break
+		}
+		value := data[i : i+length]
+		switch tag {
+		case agentCircuitIDSubopt:
+			info.circuitID = value
+		case agentRemoteIDSubopt:
+			info.remoteID = value
+		}
+		i += length
+	}
+	return info
+}
+
+// present reports whether option 82 was decoded at all, i.e. the relay
+// agent sent at least one sub-option we recognize.
+func (r relayAgentInfo) present() bool {
+	return len(r.circuitID) > 0 || len(r.remoteID) > 0
+}
+
+// port returns the switch port encoded in the circuit ID, taken as a
+// big-endian uint16 in its last two bytes - the convention our access
+// switches use.
+func (r relayAgentInfo) port() (uint16, bool) {
+	if len(r.circuitID) < 2 {
+		return 0, false
+	}
+	tail := r.circuitID[len(r.circuitID)-2:]
+	return binary.BigEndian.Uint16(tail), true
+}
+
+// switchHostname returns the remote ID interpreted as the ASCII hostname of
+// the relaying switch.
+func (r relayAgentInfo) switchHostname() string {
+	return strings.TrimRight(string(r.remoteID), "\x00")
+}
+
+// switchPort is where a static binding is expected to be plugged in,
+// mirrored from userTable's Switch/Port columns.
+type switchPort struct {
+	Switch string
+	Port   string
+}
+
+// authorizePort cross-checks the relay agent's (switch, port) against the
+// binding recorded for mac in switchPorts. It returns true when the port is
+// not tracked for this MAC (nothing to check) or matches; false means the
+// static lease MAC showed up on the wrong port and should be quarantined.
+func authorizePort(switchPorts map[string]switchPort, mac string, info relayAgentInfo) bool {
+	expected, tracked := switchPorts[mac]
+	if !tracked || (expected.Switch == "" && expected.Port == "") {
+		return true // nothing recorded for this host, can't enforce
+	}
+	if !info.present() {
+		log.Printf("Option 82 audit: MAC %v expected on switch %v port %v but relay sent no option 82, denying\n", mac, expected.Switch, expected.Port)
+		return false
+	}
+
+	portNum, ok := info.port()
+	actualPort := ""
+	if ok {
+		actualPort = strconv.Itoa(int(portNum))
+	}
+	actualSwitch := info.switchHostname()
+
+	if actualSwitch == expected.Switch && actualPort == expected.Port {
+		log.Printf("Option 82 audit: MAC %v authorized on switch %v port %v\n", mac, actualSwitch, actualPort)
+		return true
+	}
+
+	log.Printf("Option 82 audit: MAC %v expected on switch %v port %v but appeared on switch %v port %v, denying\n",
+		mac, expected.Switch, expected.Port, actualSwitch, actualPort)
+	return false
+}